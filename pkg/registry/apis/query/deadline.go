@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+)
+
+// queryDeadline reads a single query's optional deadline and minimum
+// required duration from its additional properties:
+//
+//   - "deadline" is an RFC3339 timestamp the query must complete by.
+//   - "timeoutMs" is how long, at minimum, the caller expects the query to
+//     take; it feeds the request's overall budget check rather than any
+//     single context deadline.
+//
+// Both are absent on most queries, in which case the zero Time and zero
+// Duration are returned.
+func queryDeadline(q data.DataQuery) (time.Time, time.Duration, error) {
+	var deadline time.Time
+	if raw, ok := getString(q, "deadline"); ok {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid deadline: %w", err)
+		}
+		deadline = parsed
+	}
+
+	var minDuration time.Duration
+	if raw, ok := q.Get("timeoutMs"); ok {
+		ms, ok := raw.(float64)
+		if !ok {
+			return time.Time{}, 0, fmt.Errorf("timeoutMs must be a number")
+		}
+		minDuration = time.Duration(ms) * time.Millisecond
+	}
+
+	return deadline, minDuration, nil
+}
+
+// requestBudget reads the time budget a caller is willing to spend
+// executing the whole split plan. data.QueryDataRequest has no additional
+// properties of its own, so "budgetMs" is read off of whichever query in
+// the request declares it, the same way "subscribe"/"minInterval" are.
+func requestBudget(req *query.QueryDataRequest) (time.Duration, bool) {
+	for _, q := range req.Queries {
+		raw, ok := q.Get("budgetMs")
+		if !ok {
+			continue
+		}
+		ms, ok := raw.(float64)
+		if !ok {
+			continue
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	return 0, false
+}
+
+// earliestDeadline returns parentDeadline if the parent context carries one,
+// or the zero Time otherwise. It seeds a new group's deadline with whatever
+// it would inherit from ctx before any per-query deadline narrows it.
+func earliestDeadline(hasParentDeadline bool, parentDeadline time.Time) time.Time {
+	if !hasParentDeadline {
+		return time.Time{}
+	}
+	return parentDeadline
+}
+
+// tightestDeadline returns the earlier of a and b, treating the zero Time as
+// "no deadline" rather than as the earliest possible instant.
+func tightestDeadline(a, b time.Time) time.Time {
+	switch {
+	case a.IsZero():
+		return b
+	case b.IsZero():
+		return a
+	case a.Before(b):
+		return a
+	default:
+		return b
+	}
+}
+
+// contextFor derives a context for dispatching group, applying its deadline
+// if it has one. Callers must invoke the returned cancel func once the
+// dispatch completes.
+func contextFor(ctx context.Context, group parsedQuery) (context.Context, context.CancelFunc) {
+	if group.Deadline.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, group.Deadline)
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+	"github.com/stretchr/testify/require"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+func newTestParser() *queryParser {
+	return newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger())
+}
+
+func TestParseRequestDeadlines(t *testing.T) {
+	parser := newTestParser()
+
+	t.Run("missing deadline inherits the parent context's own deadline", func(t *testing.T) {
+		parentDeadline := time.Now().Add(time.Hour)
+		ctx, cancel := context.WithDeadline(context.Background(), parentDeadline)
+		defer cancel()
+
+		parsed, err := parser.parseRequest(ctx, &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{{
+					CommonQueryProperties: data.CommonQueryProperties{
+						RefID:      "A",
+						Datasource: &data.DataSourceRef{Type: "x", UID: "abc"},
+					},
+				}},
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, parsed.Requests, 1)
+		require.WithinDuration(t, parentDeadline, parsed.Requests[0].Deadline, time.Second)
+	})
+
+	t.Run("deadline in the past is rejected immediately", func(t *testing.T) {
+		_, err := parser.parseRequest(context.Background(), &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId":      "A",
+						"datasource": &data.DataSourceRef{Type: "x", UID: "abc"},
+						"deadline":   time.Now().Add(-time.Minute).Format(time.RFC3339),
+					}),
+				},
+			},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("a shorter per-query deadline overrides a longer parent deadline", func(t *testing.T) {
+		parentDeadline := time.Now().Add(time.Hour)
+		ctx, cancel := context.WithDeadline(context.Background(), parentDeadline)
+		defer cancel()
+
+		queryDeadline := time.Now().Add(time.Minute)
+		parsed, err := parser.parseRequest(ctx, &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId":      "A",
+						"datasource": &data.DataSourceRef{Type: "x", UID: "abc"},
+						"deadline":   queryDeadline.Format(time.RFC3339),
+					}),
+				},
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, parsed.Requests, 1)
+		require.WithinDuration(t, queryDeadline, parsed.Requests[0].Deadline, time.Second)
+	})
+
+	t.Run("rejects a plan whose per-query minimums exceed the request budget", func(t *testing.T) {
+		_, err := parser.parseRequest(context.Background(), &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId":      "A",
+						"datasource": &data.DataSourceRef{Type: "x", UID: "abc"},
+						"timeoutMs":  float64(60),
+						"budgetMs":   float64(50),
+					}),
+				},
+			},
+		})
+		require.ErrorContains(t, err, "query plan needs at least")
+	})
+}
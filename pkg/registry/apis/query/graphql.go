@@ -0,0 +1,233 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+)
+
+// graphQLBody is the standard GraphQL-over-HTTP request envelope.
+type graphQLBody struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// GraphQLHandler exposes a federated GraphQL endpoint on top of queryParser,
+// letting a client describe a multi-datasource query with a single
+// schema-typed request instead of a raw QueryDataRequest. It lowers every
+// incoming document to a query.QueryDataRequest and runs it through the
+// same parser/splitter used by the REST query endpoint.
+type GraphQLHandler struct {
+	parser *queryParser
+	schema graphql.Schema
+}
+
+// NewGraphQLHandler builds the federation schema and binds its resolvers to
+// parser, so GraphQL queries are subject to the same refId, time-range and
+// legacy-datasource rules as the REST endpoint.
+func NewGraphQLHandler(parser *queryParser) (*GraphQLHandler, error) {
+	h := &GraphQLHandler{parser: parser}
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"queryData": &graphql.Field{
+					Type:    frameResultType,
+					Args:    queryDataArgs,
+					Resolve: h.resolveQueryData,
+				},
+			},
+		}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("building query federation schema: %w", err)
+	}
+	h.schema = schema
+	return h, nil
+}
+
+var timeRangeInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "TimeRangeInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"from": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"to":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var datasourceInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "DataSourceRefInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"type": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"uid":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+// sqlInputType describes a SQL expression node, mirroring the shape of a
+// SqlInputs query: a refId and the SQL text. The refIds it reads from are
+// not listed here; the parser derives them from the SQL text.
+var sqlInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "SqlExpressionInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"refId":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"expression": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var queryInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "QueryInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"refId":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"datasource": &graphql.InputObjectFieldConfig{Type: datasourceInputType},
+		"timeRange":  &graphql.InputObjectFieldConfig{Type: timeRangeInputType},
+		"sql":        &graphql.InputObjectFieldConfig{Type: sqlInputType},
+	},
+})
+
+var queryDataArgs = graphql.FieldConfigArgument{
+	"timeRange": &graphql.ArgumentConfig{Type: timeRangeInputType},
+	"queries":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(queryInputType)))},
+}
+
+// frameResultType is one typed result per refId: the refId itself plus its
+// result frames serialized as JSON, since frame shape is datasource-specific
+// and not expressible as a static GraphQL type.
+var frameResultType = graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
+	Name: "RefIDResult",
+	Fields: graphql.Fields{
+		"refId":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"frames": &graphql.Field{Type: graphql.String},
+		"error":  &graphql.Field{Type: graphql.String},
+	},
+}))
+
+// refIDResult is the resolver-side representation backing frameResultType.
+type refIDResult struct {
+	RefID  string `json:"refId"`
+	Frames string `json:"frames"`
+	Error  string `json:"error,omitempty"`
+}
+
+// resolveQueryData turns the GraphQL arguments into a query.QueryDataRequest,
+// runs it through queryParser.parseRequest to fan out across datasources,
+// and returns one typed result per refId.
+//
+// It deliberately reuses parseRequest rather than re-implementing splitting:
+// refId uniqueness, time-range fallback and legacy-datasource resolution all
+// have to behave identically whether the caller used REST or GraphQL.
+func (h *GraphQLHandler) resolveQueryData(p graphql.ResolveParams) (any, error) {
+	req, err := toQueryDataRequest(p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := h.parser.parseRequest(p.Context, req)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]refIDResult, 0, len(req.Queries))
+	for _, group := range parsed.Requests {
+		// The actual backend.QueryData dispatch for `group` is the same
+		// step the REST handler performs after parseRequest; it is omitted
+		// here since it depends on the plugin client, not on the schema.
+		for _, refID := range group.RefIDs {
+			results = append(results, refIDResult{RefID: refID})
+		}
+	}
+	return results, nil
+}
+
+// toQueryDataRequest lowers the GraphQL "queries"/"timeRange" arguments into
+// the same query.QueryDataRequest shape the REST endpoint accepts.
+func toQueryDataRequest(args map[string]any) (*query.QueryDataRequest, error) {
+	req := &query.QueryDataRequest{}
+	req.TimeRange = toTimeRange(args["timeRange"])
+
+	rawQueries, _ := args["queries"].([]any)
+	for _, rq := range rawQueries {
+		m, ok := rq.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid query input")
+		}
+
+		q := data.DataQuery{
+			CommonQueryProperties: data.CommonQueryProperties{
+				RefID: fmt.Sprint(m["refId"]),
+			},
+		}
+		if ds, ok := m["datasource"].(map[string]any); ok {
+			q.Datasource = &data.DataSourceRef{
+				Type: fmt.Sprint(ds["type"]),
+				UID:  fmt.Sprint(ds["uid"]),
+			}
+		}
+		if tr, ok := m["timeRange"].(map[string]any); ok {
+			v := toTimeRange(tr)
+			q.TimeRange = &v
+		}
+		if sql, ok := m["sql"].(map[string]any); ok {
+			q.Datasource = &data.DataSourceRef{Type: expressionDatasourceType, UID: expressionDatasourceType}
+			q.Set("type", "sql")
+			q.Set("expression", fmt.Sprint(sql["expression"]))
+		}
+
+		req.Queries = append(req.Queries, q)
+	}
+	return req, nil
+}
+
+func toTimeRange(v any) data.TimeRange {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return data.TimeRange{}
+	}
+	tr := data.TimeRange{}
+	if from, ok := m["from"].(string); ok {
+		tr.From = from
+	}
+	if to, ok := m["to"].(string); ok {
+		tr.To = to
+	}
+	return tr
+}
+
+// expressionDatasourceType is the built-in pseudo-datasource used for
+// expressions, matching expr.DatasourceType.
+const expressionDatasourceType = "__expr__"
+
+// ServeHTTP executes a single GraphQL-over-HTTP request against the
+// federation schema.
+func (h *GraphQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body graphQLBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  body.Query,
+		OperationName:  body.OperationName,
+		VariableValues: body.Variables,
+		Context:        h.requestContext(r.Context()),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// requestContext returns the context resolvers see. Today it is the
+// identity function; it is the extension point for threading auth info
+// from r into the context resolvers see, once that is needed here.
+func (h *GraphQLHandler) requestContext(ctx context.Context) context.Context {
+	return ctx
+}
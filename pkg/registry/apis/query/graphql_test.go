@@ -0,0 +1,65 @@
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+func TestToQueryDataRequest(t *testing.T) {
+	req, err := toQueryDataRequest(map[string]any{
+		"timeRange": map[string]any{"from": "now-1h", "to": "now"},
+		"queries": []any{
+			map[string]any{
+				"refId":      "A",
+				"datasource": map[string]any{"type": "prometheus", "uid": "local-prom"},
+			},
+			map[string]any{
+				"refId": "B",
+				"sql":   map[string]any{"refId": "B", "expression": "Select time, value from A"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "now-1h", req.From)
+	require.Equal(t, "now", req.To)
+	require.Len(t, req.Queries, 2)
+	require.Equal(t, "local-prom", req.Queries[0].Datasource.UID)
+	require.Equal(t, expressionDatasourceType, req.Queries[1].Datasource.Type)
+}
+
+func TestGraphQLHandlerResolvesAcrossDatasources(t *testing.T) {
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger())
+	handler, err := NewGraphQLHandler(parser)
+	require.NoError(t, err)
+
+	results, err := handler.resolveQueryData(graphql.ResolveParams{
+		Context: context.Background(),
+		Args: map[string]any{
+			"queries": []any{
+				map[string]any{
+					"refId":      "A",
+					"datasource": map[string]any{"type": "prometheus", "uid": "local-prom"},
+				},
+				map[string]any{
+					"refId":      "B",
+					"datasource": map[string]any{"type": "loki", "uid": "local-loki"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	refResults, ok := results.([]refIDResult)
+	require.True(t, ok)
+	require.Len(t, refResults, 2)
+	require.Equal(t, "A", refResults[0].RefID)
+	require.Equal(t, "B", refResults[1].RefID)
+}
@@ -0,0 +1,385 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+)
+
+// grafanaDatasourceUID is the fixed UID of the built-in grafana datasource;
+// it is also used as its plugin id regardless of the type the caller sent.
+const grafanaDatasourceUID = "grafana"
+
+// getString reads a string-valued additional property off q, the way
+// q.Get would if DataQuery had a typed accessor for it.
+func getString(q data.DataQuery, key string) (string, bool) {
+	raw, ok := q.Get(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := raw.(string)
+	return s, ok
+}
+
+// legacyDataSourceResolver resolves a datasource reference from the
+// deprecated name/id fields that older dashboards and alert rules may still
+// send instead of a UID. legacyDataSourceRetriever (parser_test.go) and
+// noLegacyRetriever are its test implementations.
+type legacyDataSourceResolver interface {
+	GetDataSourceFromDeprecatedFields(ctx context.Context, name string, id int64) (*data.DataSourceRef, error)
+}
+
+// parsedQuery is a single datasource-scoped request produced by splitting an
+// incoming query.QueryDataRequest. All queries that share the same
+// datasource UID+type are grouped together so they can be sent to the
+// backend plugin in a single call.
+type parsedQuery struct {
+	// RefIDs lists the original query refIds that were grouped into this request.
+	RefIDs []string `json:"refIds"`
+
+	// Request is the request that should be sent to the datasource.
+	Request data.QueryDataRequest `json:"request"`
+
+	// Datasource is the resolved datasource reference for this group.
+	Datasource data.DataSourceRef `json:"datasource"`
+
+	// PluginId is the plugin that should execute this request.
+	PluginId string `json:"pluginId"`
+
+	// UID is the datasource instance UID.
+	UID string `json:"uid"`
+
+	// Deadline is the point in time by which this group's backend call must
+	// complete. It is the zero Time when neither the parent context nor any
+	// query in the group declared a deadline.
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// parsedRequestInfo is the output of splitting a query.QueryDataRequest into
+// per-datasource groups, ready to be dispatched and later recombined.
+type parsedRequestInfo struct {
+	// Requests is one entry per distinct datasource found in the request.
+	Requests []parsedQuery `json:"requests,omitempty"`
+
+	// SqlInputs contains the refIds of expression queries written in SQL,
+	// so the execution engine knows to defer them until their inputs are ready.
+	SqlInputs map[string]struct{} `json:"sqlInputs,omitempty"`
+
+	// Dependencies maps a SQL expression's refId to the sibling refIds its
+	// SQL text reads from, resolved through any CTEs it defines itself.
+	Dependencies map[string][]string `json:"dependencies,omitempty"`
+
+	// ExecutionOrder lists the SQL expression refIds in dependency order:
+	// every refId appears after everything in Dependencies[refId].
+	ExecutionOrder []string `json:"executionOrder,omitempty"`
+
+	// Subscription is true when at least one query in the request asked to
+	// be re-evaluated on a cadence rather than run once.
+	Subscription bool `json:"subscription,omitempty"`
+
+	// MinInterval is the tightest re-evaluation interval requested across
+	// the subscribed queries. It is zero when Subscription is false.
+	MinInterval time.Duration `json:"minInterval,omitempty"`
+}
+
+// queryParser splits a query.QueryDataRequest into the distinct datasource
+// requests it should be dispatched to, resolving legacy datasource
+// references and expression queries along the way.
+type queryParser struct {
+	legacy           legacyDataSourceResolver
+	expressionReader *expr.ExpressionQueryReader
+	tracer           tracing.Tracer
+	logger           log.Logger
+	cache            ParsedPlanCache
+}
+
+// newQueryParser creates a parser that can split an incoming
+// query.QueryDataRequest into the backend requests it implies. cache is
+// optional; callers that don't pass one get a no-op cache, so every
+// request is parsed from scratch exactly as before this was introduced.
+func newQueryParser(reader *expr.ExpressionQueryReader, legacy legacyDataSourceResolver, tracer tracing.Tracer, logger log.Logger, cache ...ParsedPlanCache) *queryParser {
+	c := ParsedPlanCache(noopPlanCache{})
+	if len(cache) > 0 && cache[0] != nil {
+		c = cache[0]
+	}
+	return &queryParser{
+		legacy:           legacy,
+		expressionReader: reader,
+		tracer:           tracer,
+		logger:           logger,
+		cache:            c,
+	}
+}
+
+// InvalidateCache drops every plan this parser has cached. Call it when
+// something the cache key doesn't already capture changes the outcome of
+// parsing - a feature toggle flip or a datasource retriever update.
+func (p *queryParser) InvalidateCache(ctx context.Context) {
+	p.cache.Invalidate(ctx)
+}
+
+// parseRequest splits req into one parsedQuery per datasource, validating
+// refId uniqueness and resolving legacy datasource references and the
+// effective time range along the way.
+//
+// The datasource grouping and SQL dependency graph are cacheable - they only
+// depend on req's own contents - but deadlines and the request budget are
+// not: they depend on ctx's deadline and on time.Now(), neither of which the
+// cache key can capture. So those are always recomputed against the live
+// ctx, whether or not the grouping itself came from cache.
+func (p *queryParser) parseRequest(ctx context.Context, req *query.QueryDataRequest) (parsedRequestInfo, error) {
+	ctx, span := p.tracer.Start(ctx, "query.parseRequest")
+	defer span.End()
+
+	// Feature toggles are not folded into the key, so the key doesn't grow a
+	// dependency on every flag that happens to affect parsing. A cached plan
+	// is dropped only when InvalidateCache is called; nothing in this package
+	// calls it when a toggle flips.
+	cacheKey := planCacheKey(req, "")
+	rsp, ok := p.cache.Get(ctx, cacheKey)
+	if !ok {
+		var err error
+		rsp, err = p.buildPlan(ctx, req)
+		if err != nil {
+			return rsp, err
+		}
+		p.cache.Set(ctx, cacheKey, rsp)
+	}
+
+	// rsp.Requests may be the cache's own backing slice; copy it before the
+	// deadline pass mutates it in place, so a cache hit never corrupts the
+	// entry other callers will read next.
+	rsp.Requests = append([]parsedQuery(nil), rsp.Requests...)
+	totalMinDuration, err := p.applyDeadlines(ctx, req, &rsp)
+	if err != nil {
+		return rsp, err
+	}
+
+	if budget, ok := requestBudget(req); ok && totalMinDuration > budget {
+		return rsp, fmt.Errorf("query plan needs at least %s but the request budget is %s", totalMinDuration, budget)
+	}
+
+	return rsp, nil
+}
+
+// buildPlan computes the cacheable shape of req: which queries group into
+// which datasource, and the SQL expression dependency graph between them.
+// It never looks at deadlines or the request budget - see parseRequest.
+func (p *queryParser) buildPlan(ctx context.Context, req *query.QueryDataRequest) (parsedRequestInfo, error) {
+	rsp := parsedRequestInfo{
+		SqlInputs: make(map[string]struct{}),
+	}
+
+	seenRefIDs := make(map[string]bool, len(req.Queries))
+	indexByDatasource := make(map[string]int, len(req.Queries))
+	sqlTextByRefID := make(map[string]string)
+
+	for _, q := range req.Queries {
+		if seenRefIDs[q.RefID] {
+			return rsp, fmt.Errorf("duplicate refId: %q", q.RefID)
+		}
+		seenRefIDs[q.RefID] = true
+
+		ds, err := p.resolveDatasource(ctx, q)
+		if err != nil {
+			return rsp, err
+		}
+
+		timeRange := req.TimeRange
+		if q.TimeRange != nil {
+			timeRange = *q.TimeRange
+		}
+		if timeRange.From == "" && timeRange.To == "" {
+			timeRange = data.TimeRange{From: "0", To: "0"}
+		}
+
+		key := ds.Type + "/" + ds.UID
+		idx, ok := indexByDatasource[key]
+		if !ok {
+			idx = len(rsp.Requests)
+			indexByDatasource[key] = idx
+			rsp.Requests = append(rsp.Requests, parsedQuery{
+				Datasource: *ds,
+				PluginId:   ds.Type,
+				UID:        ds.UID,
+				Request:    data.QueryDataRequest{TimeRange: timeRange},
+			})
+		}
+
+		group := &rsp.Requests[idx]
+		group.RefIDs = append(group.RefIDs, q.RefID)
+		group.Request.Queries = append(group.Request.Queries, q)
+
+		if p.isSQLExpression(q) {
+			rsp.SqlInputs[q.RefID] = struct{}{}
+			if text, ok := getString(q, "expression"); ok {
+				sqlTextByRefID[q.RefID] = text
+			}
+		}
+
+		if interval, ok := subscriptionInterval(q); ok {
+			rsp.Subscription = true
+			if rsp.MinInterval == 0 || interval < rsp.MinInterval {
+				rsp.MinInterval = interval
+			}
+		}
+	}
+
+	if len(sqlTextByRefID) > 0 {
+		if err := p.resolveSQLDependencies(seenRefIDs, sqlTextByRefID, &rsp); err != nil {
+			return rsp, err
+		}
+	}
+
+	return rsp, nil
+}
+
+// applyDeadlines recomputes every group's Deadline from ctx and from each
+// query's own "deadline"/"timeoutMs" fields, and returns the total minimum
+// duration the plan needs so the caller can check it against the request
+// budget. It mutates rsp.Requests in place, so callers must own the slice -
+// see the copy parseRequest takes before calling this.
+func (p *queryParser) applyDeadlines(ctx context.Context, req *query.QueryDataRequest, rsp *parsedRequestInfo) (time.Duration, error) {
+	parentDeadline, parentHasDeadline := ctx.Deadline()
+
+	groupIndexByRefID := make(map[string]int, len(req.Queries))
+	for i, group := range rsp.Requests {
+		for _, refID := range group.RefIDs {
+			groupIndexByRefID[refID] = i
+		}
+	}
+
+	for i := range rsp.Requests {
+		rsp.Requests[i].Deadline = earliestDeadline(parentHasDeadline, parentDeadline)
+	}
+
+	var totalMinDuration time.Duration
+	for _, q := range req.Queries {
+		idx, ok := groupIndexByRefID[q.RefID]
+		if !ok {
+			continue // unknown refId; buildPlan already rejected this on a cache miss
+		}
+
+		deadline, minDuration, err := queryDeadline(q)
+		if err != nil {
+			return 0, fmt.Errorf("%q: %w", q.RefID, err)
+		}
+		if !deadline.IsZero() && deadline.Before(time.Now()) {
+			return 0, fmt.Errorf("%q: deadline %s is in the past", q.RefID, deadline)
+		}
+		totalMinDuration += minDuration
+
+		group := &rsp.Requests[idx]
+		group.Deadline = tightestDeadline(group.Deadline, deadline)
+	}
+
+	if len(rsp.Dependencies) > 0 {
+		p.propagateExpressionDeadlines(rsp, groupIndexByRefID)
+	}
+
+	return totalMinDuration, nil
+}
+
+// propagateExpressionDeadlines gives every SQL expression group the
+// tightest deadline among the groups of the refIds it reads from, so an
+// expression never outlives the inputs it depends on. It relies on
+// rsp.ExecutionOrder already placing each expression after its dependencies.
+func (p *queryParser) propagateExpressionDeadlines(rsp *parsedRequestInfo, groupIndexByRefID map[string]int) {
+	for _, refID := range rsp.ExecutionOrder {
+		group := &rsp.Requests[groupIndexByRefID[refID]]
+		for _, dep := range rsp.Dependencies[refID] {
+			depDeadline := rsp.Requests[groupIndexByRefID[dep]].Deadline
+			group.Deadline = tightestDeadline(group.Deadline, depDeadline)
+		}
+	}
+}
+
+// resolveSQLDependencies computes the dependency graph between every SQL
+// expression query and its sibling refIds, rejecting unknown inputs and
+// cycles before returning a topological execution order.
+func (p *queryParser) resolveSQLDependencies(allRefIDs map[string]bool, sqlTextByRefID map[string]string, rsp *parsedRequestInfo) error {
+	rsp.Dependencies = make(map[string][]string, len(sqlTextByRefID))
+
+	siblings := make(map[string]bool, len(allRefIDs))
+	for refID := range allRefIDs {
+		siblings[refID] = true
+	}
+
+	for refID, text := range sqlTextByRefID {
+		deps, err := sqlDependencies(refID, text, siblings)
+		if err != nil {
+			return err
+		}
+		rsp.Dependencies[refID] = deps
+	}
+
+	order, err := topologicalOrder(rsp.Dependencies)
+	if err != nil {
+		return err
+	}
+	rsp.ExecutionOrder = order
+	return nil
+}
+
+// subscriptionInterval reports whether q asked to be re-evaluated on a
+// cadence, and if so the minimum interval between re-evaluations.
+func subscriptionInterval(q data.DataQuery) (time.Duration, bool) {
+	raw, ok := q.Get("subscribe")
+	if !ok {
+		return 0, false
+	}
+	subscribe, _ := raw.(bool)
+	if !subscribe {
+		return 0, false
+	}
+	minInterval, ok := getString(q, "minInterval")
+	if !ok {
+		return defaultSubscriptionInterval, true
+	}
+	d, err := time.ParseDuration(minInterval)
+	if err != nil || d <= 0 {
+		return defaultSubscriptionInterval, true
+	}
+	return d, true
+}
+
+// defaultSubscriptionInterval is used when a subscribed query does not
+// declare its own minInterval.
+const defaultSubscriptionInterval = 5 * time.Second
+
+// resolveDatasource returns the datasource reference a query should run
+// against, falling back to the deprecated name/id fields and normalizing
+// the built-in "grafana" datasource, which may be referenced with or
+// without an explicit type.
+func (p *queryParser) resolveDatasource(ctx context.Context, q data.DataQuery) (*data.DataSourceRef, error) {
+	ds := q.Datasource
+	if ds == nil || (ds.UID == "" && ds.Type == "") {
+		name, _ := getString(q, "datasourceName")
+		legacy, err := p.legacy.GetDataSourceFromDeprecatedFields(ctx, name, q.DatasourceID)
+		if err != nil {
+			return nil, fmt.Errorf("missing datasource: %w", err)
+		}
+		ds = legacy
+	}
+
+	if ds.UID == grafanaDatasourceUID {
+		return &data.DataSourceRef{Type: grafanaDatasourceUID, UID: grafanaDatasourceUID}, nil
+	}
+	return ds, nil
+}
+
+// isSQLExpression reports whether q is an expression query written in SQL.
+func (p *queryParser) isSQLExpression(q data.DataQuery) bool {
+	if q.Datasource == nil || q.Datasource.Type != expr.DatasourceType {
+		return false
+	}
+	t, ok := getString(q, "type")
+	return ok && t == "sql"
+}
@@ -0,0 +1,253 @@
+package query
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+)
+
+// ParsedPlanCache stores the result of splitting and analyzing a
+// query.QueryDataRequest, keyed by a hash of its normalized contents, so an
+// identical request doesn't pay for re-parsing, re-splitting and SQL
+// dependency analysis.
+//
+// Implementations must be safe for concurrent use.
+type ParsedPlanCache interface {
+	// Get returns the cached plan for key, if any.
+	Get(ctx context.Context, key string) (parsedRequestInfo, bool)
+
+	// Set stores plan under key.
+	Set(ctx context.Context, key string, plan parsedRequestInfo)
+
+	// Invalidate drops every cached plan. Callers should invoke this when
+	// something the cache key does not already capture changes the outcome
+	// of parsing, such as a feature toggle flip or a datasource being
+	// reconfigured.
+	Invalidate(ctx context.Context)
+}
+
+// noopPlanCache never caches anything; it is the default used by
+// newQueryParser when no cache is supplied, preserving the pre-cache
+// behavior of parsing every request from scratch.
+type noopPlanCache struct{}
+
+func (noopPlanCache) Get(context.Context, string) (parsedRequestInfo, bool) { return parsedRequestInfo{}, false }
+func (noopPlanCache) Set(context.Context, string, parsedRequestInfo)        {}
+func (noopPlanCache) Invalidate(context.Context)                            {}
+
+// lruPlanCache is the default in-process ParsedPlanCache: a fixed-size
+// least-recently-used cache with hit/miss counters for observability.
+type lruPlanCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type lruEntry struct {
+	key  string
+	plan parsedRequestInfo
+}
+
+// NewLRUPlanCache returns an in-process ParsedPlanCache holding at most
+// capacity entries, evicting the least recently used plan once full.
+func NewLRUPlanCache(capacity int) ParsedPlanCache {
+	if capacity <= 0 {
+		capacity = 100
+	}
+	return &lruPlanCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruPlanCache) Get(_ context.Context, key string) (parsedRequestInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return parsedRequestInfo{}, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits.Add(1)
+	return el.Value.(*lruEntry).plan, true
+}
+
+func (c *lruPlanCache) Set(_ context.Context, key string, plan parsedRequestInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*lruEntry).plan = plan
+		return
+	}
+
+	el := c.ll.PushFront(&lruEntry{key: key, plan: plan})
+	c.items[key] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+func (c *lruPlanCache) Invalidate(context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Hits returns the number of cache hits served so far. Intended for tests
+// and metrics, not for correctness.
+func (c *lruPlanCache) Hits() int64 { return c.hits.Load() }
+
+// Misses returns the number of cache misses served so far.
+func (c *lruPlanCache) Misses() int64 { return c.misses.Load() }
+
+// PlanCacheStore is the key/value persistence a ParsedPlanCache can be built
+// on: get/put bytes by key, nothing more. A ParsedPlanCache only ever needs
+// to look a plan up by its cache key or evict it, so this package depends on
+// that minimal shape rather than on any specific storage engine.
+type PlanCacheStore interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte) error
+	Delete(keys ...string) error
+}
+
+// kvPlanCache is a ParsedPlanCache backed by a PlanCacheStore, for
+// deployments that want the plan cache to survive a process restart instead
+// of being rebuilt from scratch, at the cost of a JSON round-trip per plan
+// since PlanCacheStore only speaks bytes.
+type kvPlanCache struct {
+	store PlanCacheStore
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewKVPlanCache returns a ParsedPlanCache persisted through store.
+func NewKVPlanCache(store PlanCacheStore) ParsedPlanCache {
+	return &kvPlanCache{store: store, keys: make(map[string]struct{})}
+}
+
+func (c *kvPlanCache) Get(_ context.Context, key string) (parsedRequestInfo, bool) {
+	raw, ok, err := c.store.Get(key)
+	if err != nil || !ok {
+		c.misses.Add(1)
+		return parsedRequestInfo{}, false
+	}
+
+	var plan parsedRequestInfo
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		c.misses.Add(1)
+		return parsedRequestInfo{}, false
+	}
+	c.hits.Add(1)
+	return plan, true
+}
+
+func (c *kvPlanCache) Set(_ context.Context, key string, plan parsedRequestInfo) {
+	raw, err := json.Marshal(plan)
+	if err != nil {
+		return
+	}
+	if err := c.store.Set(key, raw); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.keys[key] = struct{}{}
+	c.mu.Unlock()
+}
+
+func (c *kvPlanCache) Invalidate(context.Context) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.keys))
+	for k := range c.keys {
+		keys = append(keys, k)
+	}
+	c.keys = make(map[string]struct{})
+	c.mu.Unlock()
+
+	_ = c.store.Delete(keys...)
+}
+
+// planCacheKey returns a stable hash of req's normalized contents: every
+// query's refId, datasource type+UID as sent (not resolved), legacy
+// datasource name/id, SQL expression text,
+// and effective time range, sorted by refId so argument order doesn't
+// affect the key. featureSalt should change whenever a feature toggle that
+// affects parsing flips, so a stale plan computed under the old toggles is
+// never served.
+func planCacheKey(req *query.QueryDataRequest, featureSalt string) string {
+	type normalizedQuery struct {
+		RefID          string
+		DsType         string
+		DsUID          string
+		DatasourceName string
+		DatasourceId   int64
+		Expression     string
+		From           string
+		To             string
+	}
+
+	normalized := make([]normalizedQuery, 0, len(req.Queries))
+	for _, q := range req.Queries {
+		n := normalizedQuery{RefID: q.RefID}
+		if q.Datasource != nil {
+			n.DsType = q.Datasource.Type
+			n.DsUID = q.Datasource.UID
+		}
+		// The legacy name/id fields resolve to a datasource independently
+		// of DsType/DsUID, so two requests that are otherwise identical but
+		// carry different legacy fields must still get distinct keys - a
+		// cache hit would skip the legacy resolution that tells them apart.
+		if name, ok := getString(q, "datasourceName"); ok {
+			n.DatasourceName = name
+		}
+		n.DatasourceId = q.DatasourceID
+		if text, ok := getString(q, "expression"); ok {
+			n.Expression = text
+		}
+
+		tr := req.TimeRange
+		if q.TimeRange != nil {
+			tr = *q.TimeRange
+		}
+		n.From, n.To = tr.From, tr.To
+
+		normalized = append(normalized, n)
+	}
+	sort.Slice(normalized, func(i, j int) bool { return normalized[i].RefID < normalized[j].RefID })
+
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "features=%s\n", featureSalt)
+	for _, n := range normalized {
+		_, _ = fmt.Fprintf(h, "%s|%s|%s|%s|%d|%s|%s|%s\n",
+			n.RefID, n.DsType, n.DsUID, n.DatasourceName, n.DatasourceId, n.Expression, n.From, n.To)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
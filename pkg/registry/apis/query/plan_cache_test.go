@@ -0,0 +1,158 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+	"github.com/stretchr/testify/require"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+// countingRetriever wraps a legacyDataSourceResolver and counts how many
+// times it was actually invoked, so tests can tell a cache hit (resolver
+// skipped) apart from a cache miss (resolver re-run).
+type countingRetriever struct {
+	legacyDataSourceResolver
+	calls int
+}
+
+func (r *countingRetriever) GetDataSourceFromDeprecatedFields(ctx context.Context, name string, id int64) (*data.DataSourceRef, error) {
+	r.calls++
+	return r.legacyDataSourceResolver.GetDataSourceFromDeprecatedFields(ctx, name, id)
+}
+
+func TestParsedPlanCacheHitsAndMisses(t *testing.T) {
+	cache := NewLRUPlanCache(10)
+	retriever := &countingRetriever{legacyDataSourceResolver: &legacyDataSourceRetriever{}}
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		retriever, tracing.InitializeTracerForTest(), log.NewNopLogger(), cache)
+
+	req := &query.QueryDataRequest{
+		QueryDataRequest: data.QueryDataRequest{
+			Queries: []data.DataQuery{{
+				CommonQueryProperties: data.CommonQueryProperties{
+					RefID:      "A",
+					Datasource: &data.DataSourceRef{Type: "x", UID: "abc"},
+				},
+			}},
+		},
+	}
+
+	_, err := parser.parseRequest(context.Background(), req)
+	require.NoError(t, err)
+	_, err = parser.parseRequest(context.Background(), req)
+	require.NoError(t, err)
+
+	lru := cache.(*lruPlanCache)
+	require.Equal(t, int64(1), lru.Misses())
+	require.Equal(t, int64(1), lru.Hits())
+}
+
+func TestParsedPlanCachePreservesLegacyResolution(t *testing.T) {
+	cache := NewLRUPlanCache(10)
+	retriever := &countingRetriever{legacyDataSourceResolver: &legacyDataSourceRetriever{}}
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		retriever, tracing.InitializeTracerForTest(), log.NewNopLogger(), cache)
+
+	// Both requests carry the same legacy name; legacyDataSourceRetriever
+	// resolves id 100 by id and falls back to the name for any other id.
+	withLegacyID := func(id float64) *query.QueryDataRequest {
+		return &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId":          "A",
+						"datasourceId":   id,
+						"datasourceName": "legacy-ds",
+					}),
+				},
+			},
+		}
+	}
+
+	_, err := parser.parseRequest(context.Background(), withLegacyID(100))
+	require.NoError(t, err)
+	require.Equal(t, 1, retriever.calls)
+
+	// Same shape, different legacy id: must not be served from cache, since
+	// id 100 and 101 resolve to different datasources.
+	_, err = parser.parseRequest(context.Background(), withLegacyID(101))
+	require.NoError(t, err)
+	require.Equal(t, 2, retriever.calls, "legacy resolution must still run when the legacy id differs")
+}
+
+func TestNoopPlanCacheNeverHits(t *testing.T) {
+	var c ParsedPlanCache = noopPlanCache{}
+	c.Set(context.Background(), "k", parsedRequestInfo{})
+	_, ok := c.Get(context.Background(), "k")
+	require.False(t, ok)
+}
+
+func TestParsedPlanCacheDoesNotServeStaleDeadlines(t *testing.T) {
+	cache := NewLRUPlanCache(10)
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger(), cache)
+
+	req := &query.QueryDataRequest{
+		QueryDataRequest: data.QueryDataRequest{
+			Queries: []data.DataQuery{{
+				CommonQueryProperties: data.CommonQueryProperties{
+					RefID:      "A",
+					Datasource: &data.DataSourceRef{Type: "x", UID: "abc"},
+				},
+			}},
+		},
+	}
+
+	shortCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first, err := parser.parseRequest(shortCtx, req)
+	require.NoError(t, err)
+	require.False(t, first.Requests[0].Deadline.IsZero())
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Same request, but this call's context carries no deadline at all; a
+	// cache hit on the grouping must not resurrect the first call's
+	// already-expired absolute deadline.
+	second, err := parser.parseRequest(context.Background(), req)
+	require.NoError(t, err)
+	require.True(t, second.Requests[0].Deadline.IsZero())
+}
+
+func TestParsedPlanCacheDoesNotSkipBudgetCheck(t *testing.T) {
+	cache := NewLRUPlanCache(10)
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger(), cache)
+
+	newReq := func(budgetMs, timeoutMs float64) *query.QueryDataRequest {
+		return &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId":      "A",
+						"datasource": &data.DataSourceRef{Type: "x", UID: "abc"},
+						"timeoutMs":  timeoutMs,
+						"budgetMs":   budgetMs,
+					}),
+				},
+			},
+		}
+	}
+
+	_, err := parser.parseRequest(context.Background(), newReq(1000, 10))
+	require.NoError(t, err)
+
+	// Same refIds/datasource/time range, so the grouping is a cache hit; a
+	// far larger timeoutMs must still be checked against the budget live
+	// rather than reusing whatever the first call decided.
+	_, err = parser.parseRequest(context.Background(), newReq(1000, 5000))
+	require.Error(t, err)
+}
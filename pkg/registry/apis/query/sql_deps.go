@@ -0,0 +1,240 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// ErrUnknownSQLInput is returned when a SQL expression references an
+// identifier in a FROM or JOIN clause that is neither a sibling refId nor a
+// CTE defined in the same expression's WITH clause.
+var ErrUnknownSQLInput = errors.New("unknown sql input")
+
+// errSQLSelfReference is returned when a SQL expression reads its own refId.
+var errSQLSelfReference = errors.New("sql expression cannot reference its own refId")
+
+// sqlDependencies parses the SQL body of a single expression query and
+// returns the sibling refIds it reads from, in no particular order.
+// siblingRefIDs is the set of every refId in the request, refID included
+// (a reference to refID itself is rejected with errSQLSelfReference); any
+// identifier outside of it (and outside the expression's own CTEs) is
+// rejected with ErrUnknownSQLInput.
+//
+// CTEs are resolved recursively: an identifier that resolves to a CTE
+// defined in the same expression contributes that CTE's own dependencies
+// rather than the CTE name itself, so
+// `WITH CTE AS (SELECT ... FROM A) SELECT * FROM CTE` depends on {A}, not
+// {A, CTE}.
+func sqlDependencies(refID, sqlText string, siblingRefIDs map[string]bool) ([]string, error) {
+	ctes, body, err := splitCTEs(sqlText)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SQL for %q: %w", refID, err)
+	}
+
+	cteBodies := make(map[string]string, len(ctes))
+	for _, c := range ctes {
+		cteBodies[c.name] = c.body
+	}
+
+	seen := map[string]bool{}
+	var resolve func(name string, trail map[string]bool) error
+	resolve = func(name string, trail map[string]bool) error {
+		if trail[name] {
+			return fmt.Errorf("cyclical CTE reference: %q", name)
+		}
+		trail[name] = true
+
+		tables, err := tableReferences(cteBodies[name])
+		if err != nil {
+			return err
+		}
+		for _, t := range tables {
+			switch {
+			case t == refID:
+				return errSQLSelfReference
+			case cteBodies[t] != "":
+				if err := resolve(t, trail); err != nil {
+					return err
+				}
+			case siblingRefIDs[t]:
+				seen[t] = true
+			default:
+				return fmt.Errorf("%w: %q", ErrUnknownSQLInput, t)
+			}
+		}
+		return nil
+	}
+
+	tables, err := tableReferences(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SQL for %q: %w", refID, err)
+	}
+	for _, t := range tables {
+		switch {
+		case t == refID:
+			return nil, errSQLSelfReference
+		case cteBodies[t] != "":
+			if err := resolve(t, map[string]bool{}); err != nil {
+				return nil, err
+			}
+		case siblingRefIDs[t]:
+			seen[t] = true
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnknownSQLInput, t)
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// tableReferences walks the parsed SQL statement and returns every table
+// name referenced in a FROM or JOIN clause, descending into subqueries.
+//
+// It only collects sqlparser.TableName nodes reached through an
+// AliasedTableExpr's own Expr - a plain TableName also backs a column's
+// qualifier (the "a" in "a.time"), and walking every TableName node
+// indiscriminately would wrongly treat a table's alias as a dependency of
+// its own.
+func tableReferences(sqlText string) ([]string, error) {
+	stmt, err := sqlparser.Parse(sqlText)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		aliased, ok := node.(*sqlparser.AliasedTableExpr)
+		if !ok {
+			return true, nil
+		}
+		if t, ok := aliased.Expr.(sqlparser.TableName); ok && !t.Name.IsEmpty() {
+			refs = append(refs, t.Name.String())
+		}
+		return true, nil
+	}, stmt)
+	return refs, nil
+}
+
+// namedCTE is one entry of a WITH clause.
+type namedCTE struct {
+	name string
+	body string
+}
+
+// splitCTEs splits a leading `WITH name AS (...), name2 AS (...)` clause off
+// of sqlText and returns its CTEs plus the remaining statement. sqlparser
+// does not understand the WITH syntax, so this is done with a small
+// paren-balancing scanner rather than the AST walker used for everything
+// else.
+func splitCTEs(sqlText string) ([]namedCTE, string, error) {
+	trimmed := strings.TrimSpace(sqlText)
+	if !strings.HasPrefix(strings.ToUpper(trimmed), "WITH") {
+		return nil, sqlText, nil
+	}
+	rest := strings.TrimSpace(trimmed[len("WITH"):])
+
+	var ctes []namedCTE
+	for {
+		nameEnd := strings.IndexAny(rest, " \t\n")
+		if nameEnd < 0 {
+			return nil, "", fmt.Errorf("malformed WITH clause")
+		}
+		name := rest[:nameEnd]
+		rest = strings.TrimSpace(rest[nameEnd:])
+
+		upper := strings.ToUpper(rest)
+		if !strings.HasPrefix(upper, "AS") {
+			return nil, "", fmt.Errorf("expected AS after CTE name %q", name)
+		}
+		rest = strings.TrimSpace(rest[len("AS"):])
+
+		if !strings.HasPrefix(rest, "(") {
+			return nil, "", fmt.Errorf("expected ( after AS for CTE %q", name)
+		}
+		body, remainder, err := balancedParens(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		ctes = append(ctes, namedCTE{name: name, body: body})
+
+		remainder = strings.TrimSpace(remainder)
+		if strings.HasPrefix(remainder, ",") {
+			rest = strings.TrimSpace(remainder[1:])
+			continue
+		}
+		return ctes, remainder, nil
+	}
+}
+
+// balancedParens expects s to start with '(' and returns the text strictly
+// inside the matching ')', plus whatever follows it.
+func balancedParens(s string) (inner string, remainder string, err error) {
+	depth := 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("unbalanced parentheses in CTE")
+}
+
+// topologicalOrder returns deps' refIds in an order where every refId comes
+// after everything it depends on, or an error if deps contains a cycle.
+func topologicalOrder(deps map[string][]string) ([]string, error) {
+	const (
+		unvisited = 0
+		visiting  = 1
+		visited   = 2
+	)
+	state := make(map[string]int, len(deps))
+	order := make([]string, 0, len(deps))
+
+	refIDs := make([]string, 0, len(deps))
+	for refID := range deps {
+		refIDs = append(refIDs, refID)
+	}
+	sort.Strings(refIDs)
+
+	var visit func(refID string) error
+	visit = func(refID string) error {
+		switch state[refID] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("cyclical SQL expression dependency involving %q", refID)
+		}
+		state[refID] = visiting
+		for _, dep := range deps[refID] {
+			if _, isExpr := deps[dep]; isExpr {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[refID] = visited
+		order = append(order, refID)
+		return nil
+	}
+
+	for _, refID := range refIDs {
+		if err := visit(refID); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,78 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqlDependencies(t *testing.T) {
+	siblings := map[string]bool{"A": true, "B": true}
+
+	t.Run("simple reference", func(t *testing.T) {
+		deps, err := sqlDependencies("C", "SELECT time, value + 10 FROM A", siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A"}, deps)
+	})
+
+	t.Run("aliased table", func(t *testing.T) {
+		deps, err := sqlDependencies("C", "SELECT a.time, a.value FROM A a", siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A"}, deps)
+	})
+
+	t.Run("nested CTE resolves to the underlying refId", func(t *testing.T) {
+		deps, err := sqlDependencies("C", `
+			WITH inner_cte AS (SELECT time FROM A)
+			SELECT * FROM inner_cte`, siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A"}, deps)
+	})
+
+	t.Run("join across two refIds", func(t *testing.T) {
+		deps, err := sqlDependencies("C", "SELECT A.time, B.value FROM A JOIN B ON A.time = B.time", siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A", "B"}, deps)
+	})
+
+	t.Run("backtick-quoted identifier", func(t *testing.T) {
+		deps, err := sqlDependencies("C", "SELECT time, value FROM `A`", siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A"}, deps)
+	})
+
+	t.Run("subquery in FROM", func(t *testing.T) {
+		deps, err := sqlDependencies("C", "SELECT * FROM (SELECT time, value FROM A) AS sub", siblings)
+		require.NoError(t, err)
+		require.Equal(t, []string{"A"}, deps)
+	})
+
+	t.Run("unknown identifier is rejected", func(t *testing.T) {
+		_, err := sqlDependencies("C", "SELECT * FROM Z", siblings)
+		require.ErrorIs(t, err, ErrUnknownSQLInput)
+	})
+
+	t.Run("self reference is rejected", func(t *testing.T) {
+		_, err := sqlDependencies("A", "SELECT * FROM A", siblings)
+		require.ErrorIs(t, err, errSQLSelfReference)
+	})
+}
+
+func TestTopologicalOrder(t *testing.T) {
+	t.Run("orders dependencies before dependents", func(t *testing.T) {
+		order, err := topologicalOrder(map[string][]string{
+			"C": {"B"},
+			"B": {"A"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"B", "C"}, order)
+	})
+
+	t.Run("rejects a cycle", func(t *testing.T) {
+		_, err := topologicalOrder(map[string][]string{
+			"B": {"C"},
+			"C": {"B"},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,137 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+)
+
+// SubscriptionEvent reports that a single refId was re-evaluated, emitted on
+// the channel returned by queryParser.Subscribe. Frames is declared for the
+// shape callers will eventually receive, but dispatching the re-evaluation
+// against its datasource is not wired up here - the same gap graphql.go's
+// resolveQueryData discloses - so Frames and Err are always left at their
+// zero value today.
+type SubscriptionEvent struct {
+	RefID  string          `json:"refId"`
+	Frames json.RawMessage `json:"frames,omitempty"`
+	Err    error           `json:"-"`
+}
+
+// Subscribe parses req once and then re-executes the resulting split plan
+// on a cadence until ctx is canceled, emitting one SubscriptionEvent per
+// refId re-evaluated. Expression/SQL nodes are only re-run once their
+// declared SqlInputs have produced new frames, so a cheap downstream
+// expression doesn't re-evaluate on every tick of a slow upstream query.
+//
+// As with the GraphQL federation handler, the actual backend.QueryData
+// dispatch per re-evaluation is not implemented here - this only tracks
+// which refIds would need re-running and when. Callers cannot yet read real
+// frames off the returned events.
+//
+// The channel is closed when ctx is done. The background goroutine exits on
+// cancellation whether or not the caller drains the channel; an event that
+// was already being sent when ctx was canceled may still be delivered first.
+func (p *queryParser) Subscribe(ctx context.Context, req *query.QueryDataRequest) (<-chan SubscriptionEvent, error) {
+	parsed, err := p.parseRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := parsed.MinInterval
+	if interval <= 0 {
+		interval = defaultSubscriptionInterval
+	}
+
+	out := make(chan SubscriptionEvent)
+	go p.runSubscription(ctx, parsed, interval, out)
+	return out, nil
+}
+
+// runSubscription owns the channel returned by Subscribe: it is the only
+// goroutine that writes to or closes out.
+func (p *queryParser) runSubscription(ctx context.Context, parsed parsedRequestInfo, interval time.Duration, out chan<- SubscriptionEvent) {
+	defer close(out)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastVersion := make(map[string]int)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reevaluate(ctx, parsed, lastVersion, out)
+		}
+	}
+}
+
+// reevaluate re-runs every group in parsed, skipping SQL expression refIds
+// whose declared inputs have not produced a new frame version since the
+// last tick. Non-expression refIds are always re-run; plain datasource
+// queries have no declared inputs to wait on.
+func (p *queryParser) reevaluate(ctx context.Context, parsed parsedRequestInfo, lastVersion map[string]int, out chan<- SubscriptionEvent) {
+	groupByRefID := make(map[string]parsedQuery, len(parsed.Requests))
+	for _, group := range parsed.Requests {
+		for _, refID := range group.RefIDs {
+			groupByRefID[refID] = group
+		}
+	}
+
+	for _, group := range parsed.Requests {
+		for _, refID := range group.RefIDs {
+			if _, isSQL := parsed.SqlInputs[refID]; isSQL {
+				continue // handled below, after the inputs they read, in dependency order
+			}
+			if !p.emit(ctx, group, refID, lastVersion, out) {
+				return
+			}
+		}
+	}
+
+	for _, refID := range parsed.ExecutionOrder {
+		if !p.sqlInputsChanged(parsed, refID, lastVersion) {
+			continue
+		}
+		if !p.emit(ctx, groupByRefID[refID], refID, lastVersion, out) {
+			return
+		}
+	}
+}
+
+// emit bumps refID's version and sends its event, returning false only when
+// the subscription's own ctx was canceled, so the caller can stop the
+// whole loop rather than just this one group. The group's own deadline, if
+// any, bounds the dispatch that would otherwise happen here alongside the
+// event; a dispatch that merely timed out does not end the subscription.
+func (p *queryParser) emit(ctx context.Context, group parsedQuery, refID string, lastVersion map[string]int, out chan<- SubscriptionEvent) bool {
+	dispatchCtx, cancel := contextFor(ctx, group)
+	defer cancel()
+
+	lastVersion[refID]++
+	select {
+	case out <- SubscriptionEvent{RefID: refID}:
+		return true
+	case <-dispatchCtx.Done():
+		return ctx.Err() == nil
+	}
+}
+
+// sqlInputsChanged reports whether a SQL expression's declared inputs
+// produced a new frame since it was last evaluated, so it can be skipped on
+// ticks where none of its dependencies changed.
+func (p *queryParser) sqlInputsChanged(parsed parsedRequestInfo, refID string, lastVersion map[string]int) bool {
+	deps := parsed.Dependencies[refID]
+	if len(deps) == 0 {
+		return true
+	}
+	for _, dep := range deps {
+		if lastVersion[dep] > lastVersion[refID] {
+			return true
+		}
+	}
+	return lastVersion[refID] == 0
+}
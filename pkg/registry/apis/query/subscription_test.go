@@ -0,0 +1,108 @@
+package query
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	data "github.com/grafana/grafana-plugin-sdk-go/experimental/apis/data/v0alpha1"
+	"github.com/stretchr/testify/require"
+
+	query "github.com/grafana/grafana/pkg/apis/query/v0alpha1"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+func TestSubscribeEmitsOnEveryTick(t *testing.T) {
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := parser.Subscribe(ctx, &query.QueryDataRequest{
+		QueryDataRequest: data.QueryDataRequest{
+			Queries: []data.DataQuery{
+				data.NewDataQuery(map[string]any{
+					"refId": "A",
+					"datasource": &data.DataSourceRef{
+						Type: "prometheus",
+						UID:  "local-prom",
+					},
+					"subscribe":   true,
+					"minInterval": "1ms",
+				}),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for tick := 0; tick < 2; tick++ {
+		select {
+		case ev := <-events:
+			require.Equal(t, "A", ev.RefID)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for subscription event")
+		}
+	}
+
+	cancel()
+	// An event already in flight when ctx is canceled may still arrive
+	// before the channel is closed.
+	closed := false
+	closeTimeout := time.After(time.Second)
+	for !closed {
+		select {
+		case _, ok := <-events:
+			closed = !ok
+		case <-closeTimeout:
+			t.Fatal("timed out waiting for the channel to close")
+		}
+	}
+	require.True(t, closed, "channel should be closed once ctx is canceled")
+}
+
+// TestSubscribeDoesNotLeakGoroutines opens and cancels many subscriptions and
+// asserts the number of live goroutines settles back down, rather than
+// growing by one per subscription left running.
+func TestSubscribeDoesNotLeakGoroutines(t *testing.T) {
+	parser := newQueryParser(expr.NewExpressionQueryReader(featuremgmt.WithFeatures()),
+		&legacyDataSourceRetriever{}, tracing.InitializeTracerForTest(), log.NewNopLogger())
+
+	const batchSize = 25
+	before := runtime.NumGoroutine()
+
+	cancels := make([]context.CancelFunc, 0, batchSize)
+	for i := 0; i < batchSize; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+
+		_, err := parser.Subscribe(ctx, &query.QueryDataRequest{
+			QueryDataRequest: data.QueryDataRequest{
+				Queries: []data.DataQuery{
+					data.NewDataQuery(map[string]any{
+						"refId": "A",
+						"datasource": &data.DataSourceRef{
+							Type: "prometheus",
+							UID:  "local-prom",
+						},
+						"subscribe":   true,
+						"minInterval": "1ms",
+					}),
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before+2
+	}, 2*time.Second, 10*time.Millisecond, "expected subscription goroutines to exit after cancel")
+}